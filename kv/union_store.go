@@ -14,6 +14,8 @@
 package kv
 
 import (
+	"bytes"
+
 	"github.com/juju/errors"
 	"github.com/ngaut/pool"
 	"github.com/pingcap/tidb/util/errors2"
@@ -31,11 +33,32 @@ const (
 	conditionForceSet
 )
 
-var (
-	p = pool.NewCache("memdb pool", 100, func() interface{} {
-		return NewMemDbBuffer()
-	})
-)
+// MemBufferFactory creates MemBuffer instances for the memdb pool.
+type MemBufferFactory interface {
+	NewMemBuffer() MemBuffer
+}
+
+// MemBufferFactoryFunc adapts a plain function into a MemBufferFactory.
+type MemBufferFactoryFunc func() MemBuffer
+
+// NewMemBuffer implements the MemBufferFactory interface.
+func (f MemBufferFactoryFunc) NewMemBuffer() MemBuffer {
+	return f()
+}
+
+var defaultMemBufferFactory MemBufferFactory = MemBufferFactoryFunc(func() MemBuffer {
+	return NewMemDbBuffer()
+})
+
+var p = pool.NewCache("memdb pool", 100, func() interface{} {
+	return defaultMemBufferFactory.NewMemBuffer()
+})
+
+// SetMemBufferFactory overrides the MemBuffer implementation backing the
+// memdb pool. It must be called before any UnionStore is created.
+func SetMemBufferFactory(factory MemBufferFactory) {
+	defaultMemBufferFactory = factory
+}
 
 // conditionValue is a data structure used to store current stored data and data verification condition.
 type conditionValue struct {
@@ -43,6 +66,41 @@ type conditionValue struct {
 	condition   conditionType
 }
 
+const (
+	// DefaultTxnTotalSizeLimit is the default limit of the sum of all entry
+	// sizes buffered in a single UnionStore.
+	DefaultTxnTotalSizeLimit = 100 * 1024 * 1024
+	// DefaultTxnEntryCountLimit is the default limit of the number of
+	// mutations buffered in a single UnionStore.
+	DefaultTxnEntryCountLimit = 300 * 1000
+	// DefaultTxnEntrySizeLimit is the default limit of a single key/value
+	// pair's size.
+	DefaultTxnEntrySizeLimit = 6 * 1024 * 1024
+)
+
+// UnionStoreOptions controls the size limits enforced by a UnionStore.
+// A zero value for any field disables that particular limit.
+type UnionStoreOptions struct {
+	// TxnTotalSizeLimit is the max sum of all buffered key/value sizes.
+	TxnTotalSizeLimit uint64
+	// TxnEntryCountLimit is the max number of mutations buffered in a
+	// single transaction.
+	TxnEntryCountLimit uint64
+	// TxnEntrySizeLimit is the max size of a single key/value pair.
+	TxnEntrySizeLimit int
+}
+
+// DefaultUnionStoreOptions returns UnionStoreOptions set to the Default*
+// limits above. NewUnionStore does not fall back to them: it enforces
+// exactly the options it is given.
+func DefaultUnionStoreOptions() UnionStoreOptions {
+	return UnionStoreOptions{
+		TxnTotalSizeLimit:  DefaultTxnTotalSizeLimit,
+		TxnEntryCountLimit: DefaultTxnEntryCountLimit,
+		TxnEntrySizeLimit:  DefaultTxnEntrySizeLimit,
+	}
+}
+
 // IsErrNotFound checks if err is a kind of NotFound error.
 func IsErrNotFound(err error) bool {
 	if errors2.ErrorEqual(err, ErrNotExist) {
@@ -52,6 +110,24 @@ func IsErrNotFound(err error) bool {
 	return false
 }
 
+var (
+	// ErrTxnTooLarge is returned when the total size or number of mutations
+	// buffered in a UnionStore exceeds its configured limit.
+	ErrTxnTooLarge = errors.New("transaction is too large")
+	// ErrEntryTooLarge is returned when a single key/value pair exceeds its
+	// configured size limit.
+	ErrEntryTooLarge = errors.New("entry is too large")
+	// ErrCannotSetNilValue is returned when Set is called with a nil value.
+	// nil is reserved internally to mark a deleted key; a zero-length but
+	// non-nil value (e.g. []byte{}) is a legitimate value and is allowed.
+	ErrCannotSetNilValue = errors.New("can not set nil value")
+)
+
+// StagingHandle refers to a staging buffer layer pushed onto a MemBuffer by
+// Staging. The zero value is never returned by Staging and is reserved to
+// mean "no staging layer".
+type StagingHandle int
+
 // MemBuffer is the interface for transaction buffer of update in a transaction
 type MemBuffer interface {
 	// shares the same interface as the read-only snapshot
@@ -59,20 +135,56 @@ type MemBuffer interface {
 	Snapshot
 	// Set associates key with value
 	Set([]byte, []byte) error
+	// Staging pushes a new layer onto the buffer's internal stack.
+	Staging() StagingHandle
+	// ReleaseStaging merges the layer identified by h, and every layer
+	// above it, into the layer below, publishing their writes.
+	ReleaseStaging(h StagingHandle)
+	// Cleanup discards the layer identified by h, and every layer above it,
+	// without publishing their writes.
+	Cleanup(h StagingHandle)
+	// SeekReverse returns an Iterator that walks keys in descending order
+	// starting from key, or from the last key if key is nil.
+	SeekReverse(key []byte) (Iterator, error)
+}
+
+// BatchGetter is the interface for BatchGet.
+type BatchGetter interface {
+	// BatchGet gets a batch of values from kv storage.
+	// The returned map only contains keys that are found and have a value.
+	BatchGet(keys [][]byte) (map[string][]byte, error)
+}
+
+// unionStoreCheckpoint is the size/entries bookkeeping saved by Staging so
+// Cleanup can restore it after a savepoint rollback.
+type unionStoreCheckpoint struct {
+	handle  StagingHandle
+	size    int
+	entries int
 }
 
 // UnionStore is an implement of Store which contains a buffer for update.
 type UnionStore struct {
 	Dirty    MemBuffer // updates are buffered in memory
 	Snapshot Snapshot  // for read
+	opts     UnionStoreOptions
+	size     int // sum of buffered key/value sizes
+	entries  int // number of mutations buffered in Dirty
+	// checkpoints mirrors the stack of staging layers pushed by Staging,
+	// one entry per open StagingHandle, so Cleanup can roll size/entries
+	// back to what they were before a given layer, and everything above it,
+	// was pushed. ReleaseStaging drops the same entries and keeps the
+	// current size/entries.
+	checkpoints []unionStoreCheckpoint
 }
 
-// NewUnionStore builds a new UnionStore.
-func NewUnionStore(snapshot Snapshot) (UnionStore, error) {
+// NewUnionStore builds a new UnionStore with the given limits.
+func NewUnionStore(snapshot Snapshot, opts UnionStoreOptions) (UnionStore, error) {
 	dirty := p.Get().(MemBuffer)
 	return UnionStore{
 		Dirty:    dirty,
 		Snapshot: snapshot,
+		opts:     opts,
 	}, nil
 }
 
@@ -88,35 +200,265 @@ func (us *UnionStore) Get(key []byte) (value []byte, err error) {
 		return nil, errors.Trace(err)
 	}
 
-	if len(value) == 0 { // Deleted marker
+	if value == nil { // Deleted marker
 		return nil, errors.Trace(ErrNotExist)
 	}
 
 	return value, nil
 }
 
+// BatchGet implements the BatchGetter interface.
+func (us *UnionStore) BatchGet(keys [][]byte) (map[string][]byte, error) {
+	result := make(map[string][]byte, len(keys))
+	var missing [][]byte
+	for _, k := range keys {
+		val, err := us.Dirty.Get(k)
+		if IsErrNotFound(err) {
+			missing = append(missing, k)
+			continue
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if val == nil { // Deleted marker, key is tombstoned in the buffer.
+			continue
+		}
+		result[string(k)] = val
+	}
+
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	batchGetter, ok := us.Snapshot.(BatchGetter)
+	if !ok {
+		for _, k := range missing {
+			val, err := us.Snapshot.Get(k)
+			if IsErrNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			result[string(k)] = val
+		}
+		return result, nil
+	}
+
+	snapshotResult, err := batchGetter.BatchGet(missing)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for k, v := range snapshotResult {
+		result[k] = v
+	}
+	return result, nil
+}
+
 // Set implements the Store Set interface.
 func (us *UnionStore) Set(key []byte, value []byte) error {
-	return us.Dirty.Set(key, value)
+	if value == nil {
+		return errors.Trace(ErrCannotSetNilValue)
+	}
+
+	entrySize := len(key) + len(value)
+	if us.opts.TxnEntrySizeLimit > 0 && entrySize > us.opts.TxnEntrySizeLimit {
+		return errors.Trace(ErrEntryTooLarge)
+	}
+
+	oldValue, err := us.Dirty.Get(key)
+	isNewEntry := IsErrNotFound(err)
+	if err != nil && !isNewEntry {
+		return errors.Trace(err)
+	}
+
+	if isNewEntry && us.opts.TxnEntryCountLimit > 0 && uint64(us.entries+1) > us.opts.TxnEntryCountLimit {
+		return errors.Trace(ErrTxnTooLarge)
+	}
+
+	delta := entrySize
+	if !isNewEntry {
+		delta -= len(key) + len(oldValue)
+	}
+	if us.opts.TxnTotalSizeLimit > 0 && uint64(us.size+delta) > us.opts.TxnTotalSizeLimit {
+		return errors.Trace(ErrTxnTooLarge)
+	}
+
+	if err := us.Dirty.Set(key, value); err != nil {
+		return errors.Trace(err)
+	}
+
+	us.size += delta
+	if isNewEntry {
+		us.entries++
+	}
+	return nil
 }
 
-// Seek implements the Snapshot Seek interface.
+// Seek implements the Snapshot Seek interface. The returned iterator merges
+// the dirty MemBuffer and Snapshot streams and transparently skips keys
+// whose dirty value is the nil tombstone marker.
 func (us *UnionStore) Seek(key []byte, txn Transaction) (Iterator, error) {
 	snapshotIt := us.Snapshot.NewIterator(key)
 	dirtyIt := us.Dirty.NewIterator(key)
 	it := newUnionIter(dirtyIt, snapshotIt)
-	return it, nil
+	return newTombstoneFilterIter(it), nil
+}
+
+// SeekReverse implements the Snapshot SeekReverse interface. The returned
+// iterator merges the dirty MemBuffer and Snapshot streams and transparently
+// skips keys whose dirty value is the nil tombstone marker.
+func (us *UnionStore) SeekReverse(key []byte) (Iterator, error) {
+	snapshotIt, err := us.Snapshot.SeekReverse(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	dirtyIt, err := us.Dirty.SeekReverse(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	it := newReverseUnionIter(dirtyIt, snapshotIt)
+	return newTombstoneFilterIter(it), nil
+}
+
+// tombstoneFilterIter wraps an Iterator and transparently skips entries
+// whose value is the nil deleted marker, so callers never observe keys that
+// are tombstoned in the dirty buffer.
+type tombstoneFilterIter struct {
+	it  Iterator
+	err error
+}
+
+func newTombstoneFilterIter(it Iterator) *tombstoneFilterIter {
+	f := &tombstoneFilterIter{it: it}
+	f.skipTombstones()
+	return f
+}
+
+func (f *tombstoneFilterIter) skipTombstones() {
+	for f.err == nil && f.it.Valid() && f.it.Value() == nil {
+		f.err = f.it.Next()
+	}
+}
+
+// Valid implements the Iterator interface.
+func (f *tombstoneFilterIter) Valid() bool {
+	return f.err == nil && f.it.Valid()
+}
+
+// Key implements the Iterator interface.
+func (f *tombstoneFilterIter) Key() []byte {
+	return f.it.Key()
+}
+
+// Value implements the Iterator interface.
+func (f *tombstoneFilterIter) Value() []byte {
+	return f.it.Value()
+}
+
+// Next implements the Iterator interface.
+func (f *tombstoneFilterIter) Next() error {
+	if f.err != nil {
+		return f.err
+	}
+	if err := f.it.Next(); err != nil {
+		f.err = err
+		return err
+	}
+	f.skipTombstones()
+	return f.err
+}
+
+// Close implements the Iterator interface.
+func (f *tombstoneFilterIter) Close() {
+	f.it.Close()
+}
+
+// reverseUnionIter merges dirtyIt and snapshotIt, both descending iterators
+// over the same key range, into a single descending stream. On a key
+// present in both, the dirty value wins and the snapshot iterator is
+// advanced past it, mirroring newUnionIter's merge semantics for the
+// forward path.
+type reverseUnionIter struct {
+	dirtyIt    Iterator
+	snapshotIt Iterator
+	err        error
+}
+
+func newReverseUnionIter(dirtyIt, snapshotIt Iterator) *reverseUnionIter {
+	return &reverseUnionIter{dirtyIt: dirtyIt, snapshotIt: snapshotIt}
+}
+
+// Valid implements the Iterator interface.
+func (r *reverseUnionIter) Valid() bool {
+	return r.err == nil && (r.dirtyIt.Valid() || r.snapshotIt.Valid())
+}
+
+// Key implements the Iterator interface.
+func (r *reverseUnionIter) Key() []byte {
+	if !r.dirtyIt.Valid() {
+		return r.snapshotIt.Key()
+	}
+	if !r.snapshotIt.Valid() {
+		return r.dirtyIt.Key()
+	}
+	if bytes.Compare(r.dirtyIt.Key(), r.snapshotIt.Key()) >= 0 {
+		return r.dirtyIt.Key()
+	}
+	return r.snapshotIt.Key()
+}
+
+// Value implements the Iterator interface.
+func (r *reverseUnionIter) Value() []byte {
+	if !r.dirtyIt.Valid() {
+		return r.snapshotIt.Value()
+	}
+	if !r.snapshotIt.Valid() {
+		return r.dirtyIt.Value()
+	}
+	if bytes.Compare(r.dirtyIt.Key(), r.snapshotIt.Key()) >= 0 {
+		return r.dirtyIt.Value()
+	}
+	return r.snapshotIt.Value()
+}
+
+// Next implements the Iterator interface.
+func (r *reverseUnionIter) Next() error {
+	if r.err != nil {
+		return r.err
+	}
+	dirtyValid, snapshotValid := r.dirtyIt.Valid(), r.snapshotIt.Valid()
+	cmp := 0
+	if dirtyValid && snapshotValid {
+		cmp = bytes.Compare(r.dirtyIt.Key(), r.snapshotIt.Key())
+	}
+	if dirtyValid && (!snapshotValid || cmp >= 0) {
+		r.err = r.dirtyIt.Next()
+	}
+	if snapshotValid && (!dirtyValid || cmp <= 0) {
+		if err := r.snapshotIt.Next(); err != nil && r.err == nil {
+			r.err = err
+		}
+	}
+	return r.err
+}
+
+// Close implements the Iterator interface.
+func (r *reverseUnionIter) Close() {
+	r.dirtyIt.Close()
+	r.snapshotIt.Close()
 }
 
 // Delete implements the Store Delete interface.
 func (us *UnionStore) Delete(k []byte) error {
 	// Mark as deleted
 	val, err := us.Dirty.Get(k)
-	if err != nil {
-		if !IsErrNotFound(err) { // something wrong
-			return errors.Trace(err)
-		}
+	isNewEntry := IsErrNotFound(err)
+	if err != nil && !isNewEntry { // something wrong
+		return errors.Trace(err)
+	}
 
+	if isNewEntry {
 		// missed in dirty
 		val, err = us.Snapshot.Get(k)
 		if err != nil {
@@ -126,11 +468,71 @@ func (us *UnionStore) Delete(k []byte) error {
 		}
 	}
 
-	if len(val) == 0 { // deleted marker, already deleted
+	if val == nil { // deleted marker, already deleted
 		return errors.Trace(ErrNotExist)
 	}
 
-	return us.Dirty.Set(k, nil)
+	if us.opts.TxnEntrySizeLimit > 0 && len(k) > us.opts.TxnEntrySizeLimit {
+		return errors.Trace(ErrEntryTooLarge)
+	}
+
+	if isNewEntry && us.opts.TxnEntryCountLimit > 0 && uint64(us.entries+1) > us.opts.TxnEntryCountLimit {
+		return errors.Trace(ErrTxnTooLarge)
+	}
+
+	delta := len(k)
+	if !isNewEntry {
+		delta -= len(k) + len(val)
+	}
+	if us.opts.TxnTotalSizeLimit > 0 && uint64(us.size+delta) > us.opts.TxnTotalSizeLimit {
+		return errors.Trace(ErrTxnTooLarge)
+	}
+
+	if err := us.Dirty.Set(k, nil); err != nil {
+		return errors.Trace(err)
+	}
+
+	us.size += delta
+	if isNewEntry {
+		us.entries++
+	}
+	return nil
+}
+
+// Staging pushes a new staging layer onto the Dirty MemBuffer.
+func (us *UnionStore) Staging() StagingHandle {
+	h := us.Dirty.Staging()
+	us.checkpoints = append(us.checkpoints, unionStoreCheckpoint{handle: h, size: us.size, entries: us.entries})
+	return h
+}
+
+// dropCheckpointsThrough discards the checkpoint for h, and every checkpoint
+// pushed after it. It returns the checkpoint taken for h and whether h was
+// found.
+func (us *UnionStore) dropCheckpointsThrough(h StagingHandle) (unionStoreCheckpoint, bool) {
+	for i := len(us.checkpoints) - 1; i >= 0; i-- {
+		if us.checkpoints[i].handle == h {
+			cp := us.checkpoints[i]
+			us.checkpoints = us.checkpoints[:i]
+			return cp, true
+		}
+	}
+	return unionStoreCheckpoint{}, false
+}
+
+// ReleaseStaging implements the MemBuffer ReleaseStaging interface.
+func (us *UnionStore) ReleaseStaging(h StagingHandle) {
+	us.dropCheckpointsThrough(h)
+	us.Dirty.ReleaseStaging(h)
+}
+
+// Cleanup implements the MemBuffer Cleanup interface.
+func (us *UnionStore) Cleanup(h StagingHandle) {
+	if cp, ok := us.dropCheckpointsThrough(h); ok {
+		us.size = cp.size
+		us.entries = cp.entries
+	}
+	us.Dirty.Cleanup(h)
 }
 
 // Close implements the Store Close interface.
@@ -140,3 +542,30 @@ func (us *UnionStore) Close() error {
 	p.Put(us.Dirty)
 	return nil
 }
+
+// Len returns the number of mutations buffered in the Dirty MemBuffer.
+func (us *UnionStore) Len() int {
+	return us.entries
+}
+
+// Size returns the sum of buffered key/value sizes in the Dirty MemBuffer.
+func (us *UnionStore) Size() int {
+	return us.size
+}
+
+// WalkMemBuffer iterates the buffered mutations of mb in key order, calling
+// f with each key and its dirty value (a nil value means the key is
+// tombstoned).
+func WalkMemBuffer(mb MemBuffer, f func(k, v []byte) error) error {
+	iter := mb.NewIterator(nil)
+	defer iter.Close()
+	for iter.Valid() {
+		if err := f(iter.Key(), iter.Value()); err != nil {
+			return errors.Trace(err)
+		}
+		if err := iter.Next(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,516 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/juju/errors"
+)
+
+// fakeIterator is a minimal Iterator over pre-sorted key/value pairs, used
+// to back fakeSnapshot and fakeMemBuffer in these tests.
+type fakeIterator struct {
+	keys   [][]byte
+	values [][]byte
+	idx    int
+}
+
+func newFakeIterator(data map[string][]byte, from []byte) *fakeIterator {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	it := &fakeIterator{}
+	for _, k := range keys {
+		if from != nil && k < string(from) {
+			continue
+		}
+		it.keys = append(it.keys, []byte(k))
+		it.values = append(it.values, data[k])
+	}
+	return it
+}
+
+func newFakeReverseIterator(data map[string][]byte, from []byte) *fakeIterator {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+
+	it := &fakeIterator{}
+	for _, k := range keys {
+		if from != nil && k > string(from) {
+			continue
+		}
+		it.keys = append(it.keys, []byte(k))
+		it.values = append(it.values, data[k])
+	}
+	return it
+}
+
+func (it *fakeIterator) Valid() bool   { return it.idx < len(it.keys) }
+func (it *fakeIterator) Key() []byte   { return it.keys[it.idx] }
+func (it *fakeIterator) Value() []byte { return it.values[it.idx] }
+func (it *fakeIterator) Next() error   { it.idx++; return nil }
+func (it *fakeIterator) Close()        {}
+
+// fakeSnapshot is a map-backed Snapshot for tests.
+type fakeSnapshot struct {
+	data map[string][]byte
+}
+
+func newFakeSnapshot(data map[string][]byte) *fakeSnapshot {
+	if data == nil {
+		data = make(map[string][]byte)
+	}
+	return &fakeSnapshot{data: data}
+}
+
+func (s *fakeSnapshot) Get(k []byte) ([]byte, error) {
+	v, ok := s.data[string(k)]
+	if !ok {
+		return nil, errors.Trace(ErrNotExist)
+	}
+	return v, nil
+}
+
+func (s *fakeSnapshot) NewIterator(key []byte) Iterator {
+	return newFakeIterator(s.data, key)
+}
+
+func (s *fakeSnapshot) SeekReverse(key []byte) (Iterator, error) {
+	return newFakeReverseIterator(s.data, key), nil
+}
+
+func (s *fakeSnapshot) Release() {}
+
+// fakeMemBuffer is a layered, map-backed MemBuffer for tests. Each Staging
+// call pushes a new layer; ReleaseStaging merges the layer for a handle, and
+// every layer above it, into the layer below, and Cleanup discards them,
+// mirroring the real memdb's savepoint stack.
+type fakeMemBuffer struct {
+	layers []map[string][]byte
+}
+
+func newFakeMemBuffer() *fakeMemBuffer {
+	return &fakeMemBuffer{layers: []map[string][]byte{make(map[string][]byte)}}
+}
+
+func (b *fakeMemBuffer) top() map[string][]byte {
+	return b.layers[len(b.layers)-1]
+}
+
+func (b *fakeMemBuffer) Get(k []byte) ([]byte, error) {
+	for i := len(b.layers) - 1; i >= 0; i-- {
+		if v, ok := b.layers[i][string(k)]; ok {
+			return v, nil
+		}
+	}
+	return nil, errors.Trace(ErrNotExist)
+}
+
+func (b *fakeMemBuffer) Set(k, v []byte) error {
+	b.top()[string(k)] = v
+	return nil
+}
+
+func (b *fakeMemBuffer) NewIterator(key []byte) Iterator {
+	merged := make(map[string][]byte)
+	for _, layer := range b.layers {
+		for k, v := range layer {
+			merged[k] = v
+		}
+	}
+	return newFakeIterator(merged, key)
+}
+
+func (b *fakeMemBuffer) SeekReverse(key []byte) (Iterator, error) {
+	merged := make(map[string][]byte)
+	for _, layer := range b.layers {
+		for k, v := range layer {
+			merged[k] = v
+		}
+	}
+	return newFakeReverseIterator(merged, key), nil
+}
+
+func (b *fakeMemBuffer) Release() {}
+
+func (b *fakeMemBuffer) Staging() StagingHandle {
+	b.layers = append(b.layers, make(map[string][]byte))
+	return StagingHandle(len(b.layers) - 1)
+}
+
+func (b *fakeMemBuffer) ReleaseStaging(h StagingHandle) {
+	idx := int(h)
+	if idx < 1 || idx >= len(b.layers) {
+		return
+	}
+	below := b.layers[idx-1]
+	for i := idx; i < len(b.layers); i++ {
+		for k, v := range b.layers[i] {
+			below[k] = v
+		}
+	}
+	b.layers = b.layers[:idx]
+}
+
+func (b *fakeMemBuffer) Cleanup(h StagingHandle) {
+	idx := int(h)
+	if idx < 1 || idx >= len(b.layers) {
+		return
+	}
+	b.layers = b.layers[:idx]
+}
+
+func newTestUnionStore(snapshotData map[string][]byte) *UnionStore {
+	return &UnionStore{
+		Dirty:    newFakeMemBuffer(),
+		Snapshot: newFakeSnapshot(snapshotData),
+		opts:     DefaultUnionStoreOptions(),
+	}
+}
+
+func TestUnionStoreSetRejectsNilButAllowsEmptyValue(t *testing.T) {
+	us := newTestUnionStore(nil)
+
+	if err := us.Set([]byte("k"), nil); errors.Cause(err) != ErrCannotSetNilValue {
+		t.Fatalf("Set with nil value should return ErrCannotSetNilValue, got %v", err)
+	}
+
+	if err := us.Set([]byte("k"), []byte{}); err != nil {
+		t.Fatalf("Set with empty non-nil value should succeed, got %v", err)
+	}
+	v, err := us.Get([]byte("k"))
+	if err != nil {
+		t.Fatalf("Get after setting an empty value should succeed, got %v", err)
+	}
+	if len(v) != 0 {
+		t.Fatalf("expected empty value, got %v", v)
+	}
+}
+
+func TestUnionStoreDeleteThenGetReturnsNotFound(t *testing.T) {
+	us := newTestUnionStore(map[string][]byte{"k": []byte("v")})
+
+	if err := us.Delete([]byte("k")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := us.Get([]byte("k")); !IsErrNotFound(err) {
+		t.Fatalf("Get after Delete should be not-found, got %v", err)
+	}
+	if err := us.Delete([]byte("k")); !IsErrNotFound(err) {
+		t.Fatalf("Delete on an already-deleted key should be not-found, got %v", err)
+	}
+}
+
+func TestUnionStoreBatchGet(t *testing.T) {
+	us := newTestUnionStore(map[string][]byte{
+		"a": []byte("snapshot-a"),
+		"b": []byte("snapshot-b"),
+		"c": []byte("snapshot-c"),
+	})
+
+	if err := us.Set([]byte("b"), []byte("dirty-b")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := us.Delete([]byte("c")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	result, err := us.BatchGet([][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("missing")})
+	if err != nil {
+		t.Fatalf("BatchGet failed: %v", err)
+	}
+
+	if string(result["a"]) != "snapshot-a" {
+		t.Fatalf("expected snapshot value for a, got %q", result["a"])
+	}
+	if string(result["b"]) != "dirty-b" {
+		t.Fatalf("expected dirty override for b, got %q", result["b"])
+	}
+	if _, ok := result["c"]; ok {
+		t.Fatalf("deleted key c should not appear in BatchGet result")
+	}
+	if _, ok := result["missing"]; ok {
+		t.Fatalf("absent key should not appear in BatchGet result")
+	}
+}
+
+func TestUnionStoreLenAndSize(t *testing.T) {
+	us := newTestUnionStore(nil)
+
+	if err := us.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if us.Len() != 1 {
+		t.Fatalf("expected Len()==1, got %d", us.Len())
+	}
+	wantSize := len("k1") + len("v1")
+	if us.Size() != wantSize {
+		t.Fatalf("expected Size()==%d, got %d", wantSize, us.Size())
+	}
+
+	if err := us.Set([]byte("k1"), []byte("v1-updated")); err != nil {
+		t.Fatalf("Set (update) failed: %v", err)
+	}
+	if us.Len() != 1 {
+		t.Fatalf("updating an existing key should not change Len(), got %d", us.Len())
+	}
+	wantSize = len("k1") + len("v1-updated")
+	if us.Size() != wantSize {
+		t.Fatalf("expected Size()==%d after update, got %d", wantSize, us.Size())
+	}
+}
+
+func TestUnionStoreEntryCountLimit(t *testing.T) {
+	us := newTestUnionStore(nil)
+	us.opts.TxnEntryCountLimit = 1
+
+	if err := us.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatalf("first Set should succeed, got %v", err)
+	}
+	if err := us.Set([]byte("k2"), []byte("v2")); errors.Cause(err) != ErrTxnTooLarge {
+		t.Fatalf("second Set should hit ErrTxnTooLarge, got %v", err)
+	}
+}
+
+func TestUnionStoreEntrySizeLimit(t *testing.T) {
+	us := newTestUnionStore(nil)
+	us.opts.TxnEntrySizeLimit = 4
+
+	if err := us.Set([]byte("k"), []byte("toolarge")); errors.Cause(err) != ErrEntryTooLarge {
+		t.Fatalf("Set exceeding entry size limit should hit ErrEntryTooLarge, got %v", err)
+	}
+}
+
+func TestUnionStoreDeleteEntrySizeLimit(t *testing.T) {
+	us := newTestUnionStore(map[string][]byte{"toolongkey": []byte("v")})
+	us.opts.TxnEntrySizeLimit = 4
+
+	if err := us.Delete([]byte("toolongkey")); errors.Cause(err) != ErrEntryTooLarge {
+		t.Fatalf("Delete exceeding entry size limit should hit ErrEntryTooLarge, got %v", err)
+	}
+}
+
+func TestUnionStoreDeleteTotalSizeLimit(t *testing.T) {
+	us := newTestUnionStore(map[string][]byte{"k1": []byte("v1")})
+	us.opts.TxnTotalSizeLimit = 1
+
+	if err := us.Delete([]byte("k1")); errors.Cause(err) != ErrTxnTooLarge {
+		t.Fatalf("Delete exceeding total size limit should hit ErrTxnTooLarge, got %v", err)
+	}
+}
+
+func TestUnionStoreStagingCleanupRestoresCounters(t *testing.T) {
+	us := newTestUnionStore(nil)
+
+	if err := us.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	sizeBefore, entriesBefore := us.Size(), us.Len()
+
+	h := us.Staging()
+	if err := us.Set([]byte("k2"), []byte("v2")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if us.Len() == entriesBefore {
+		t.Fatalf("expected Len() to grow inside the staging layer")
+	}
+
+	us.Cleanup(h)
+	if us.Size() != sizeBefore || us.Len() != entriesBefore {
+		t.Fatalf("Cleanup should restore size/entries to pre-Staging values, got size=%d entries=%d, want size=%d entries=%d",
+			us.Size(), us.Len(), sizeBefore, entriesBefore)
+	}
+	if _, err := us.Get([]byte("k2")); !IsErrNotFound(err) {
+		t.Fatalf("k2 should be gone after Cleanup, got %v", err)
+	}
+
+	h2 := us.Staging()
+	if err := us.Set([]byte("k3"), []byte("v3")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	us.ReleaseStaging(h2)
+	if us.Len() != entriesBefore+1 {
+		t.Fatalf("ReleaseStaging should keep the staged write, got Len()=%d", us.Len())
+	}
+	if _, err := us.Get([]byte("k3")); err != nil {
+		t.Fatalf("k3 should survive ReleaseStaging, got %v", err)
+	}
+}
+
+func TestUnionStoreCleanupRollsBackNestedSavepoints(t *testing.T) {
+	us := newTestUnionStore(nil)
+
+	if err := us.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	sizeBefore, entriesBefore := us.Size(), us.Len()
+
+	h1 := us.Staging()
+	if err := us.Set([]byte("k2"), []byte("v2")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	us.Staging()
+	if err := us.Set([]byte("k3"), []byte("v3")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// Cleanup(h1) should discard both the inner layer and h1's own layer in one
+	// call, matching the MemBuffer contract of "h, and every layer above it".
+	us.Cleanup(h1)
+
+	if us.Size() != sizeBefore || us.Len() != entriesBefore {
+		t.Fatalf("Cleanup(h1) should restore size/entries to pre-h1 values, got size=%d entries=%d, want size=%d entries=%d",
+			us.Size(), us.Len(), sizeBefore, entriesBefore)
+	}
+	if _, err := us.Get([]byte("k2")); !IsErrNotFound(err) {
+		t.Fatalf("k2 should be gone after Cleanup(h1), got %v", err)
+	}
+	if _, err := us.Get([]byte("k3")); !IsErrNotFound(err) {
+		t.Fatalf("k3 should be gone after Cleanup(h1), got %v", err)
+	}
+}
+
+func TestTombstoneFilterIterSkipsDeletedKeys(t *testing.T) {
+	it := newTombstoneFilterIter(newFakeIterator(map[string][]byte{
+		"a": []byte("1"),
+		"b": nil,
+		"c": []byte("3"),
+	}, nil))
+	defer it.Close()
+
+	var seen []string
+	for it.Valid() {
+		seen = append(seen, string(it.Key()))
+		if err := it.Next(); err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+	}
+	if len(seen) != 2 || seen[0] != "a" || seen[1] != "c" {
+		t.Fatalf("expected [a c], got %v", seen)
+	}
+}
+
+func TestReverseUnionIterMergesDescending(t *testing.T) {
+	dirtyIt := newFakeReverseIterator(map[string][]byte{
+		"b": []byte("dirty-b"),
+		"d": nil, // tombstoned, must not appear
+	}, nil)
+	snapshotIt := newFakeReverseIterator(map[string][]byte{
+		"a": []byte("snap-a"),
+		"b": []byte("snap-b"), // shadowed by dirty
+		"c": []byte("snap-c"),
+	}, nil)
+
+	it := newTombstoneFilterIter(newReverseUnionIter(dirtyIt, snapshotIt))
+	defer it.Close()
+
+	var keys []string
+	var values []string
+	for it.Valid() {
+		keys = append(keys, string(it.Key()))
+		values = append(values, string(it.Value()))
+		if err := it.Next(); err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+	}
+
+	wantKeys := []string{"c", "b", "a"}
+	if len(keys) != len(wantKeys) {
+		t.Fatalf("expected keys %v, got %v", wantKeys, keys)
+	}
+	for i, k := range wantKeys {
+		if keys[i] != k {
+			t.Fatalf("expected keys %v, got %v", wantKeys, keys)
+		}
+	}
+	if values[1] != "dirty-b" {
+		t.Fatalf("expected dirty value to shadow snapshot for key b, got %q", values[1])
+	}
+}
+
+func TestUnionStoreSeekReverseSkipsTombstonesAndAppliesUpperBound(t *testing.T) {
+	us := newTestUnionStore(map[string][]byte{
+		"a": []byte("snap-a"),
+		"b": []byte("snap-b"),
+		"c": []byte("snap-c"),
+		"e": []byte("snap-e"),
+	})
+	if err := us.Set([]byte("b"), []byte("dirty-b")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := us.Delete([]byte("c")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	it, err := us.SeekReverse([]byte("d"))
+	if err != nil {
+		t.Fatalf("SeekReverse failed: %v", err)
+	}
+	defer it.Close()
+
+	var keys, values []string
+	for it.Valid() {
+		keys = append(keys, string(it.Key()))
+		values = append(values, string(it.Value()))
+		if err := it.Next(); err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+	}
+
+	wantKeys := []string{"b", "a"}
+	if len(keys) != len(wantKeys) {
+		t.Fatalf("expected keys %v, got %v", wantKeys, keys)
+	}
+	for i, k := range wantKeys {
+		if keys[i] != k {
+			t.Fatalf("expected keys %v, got %v", wantKeys, keys)
+		}
+	}
+	if values[0] != "dirty-b" {
+		t.Fatalf("expected dirty value to shadow snapshot for key b, got %q", values[0])
+	}
+}
+
+func TestUnionStoreEmptyValueSurvivesSeekAndSeekReverse(t *testing.T) {
+	us := newTestUnionStore(nil)
+	if err := us.Set([]byte("k"), []byte{}); err != nil {
+		t.Fatalf("Set with empty non-nil value should succeed, got %v", err)
+	}
+
+	it, err := us.Seek(nil, nil)
+	if err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	defer it.Close()
+	if !it.Valid() || string(it.Key()) != "k" {
+		t.Fatalf("expected Seek to surface key with empty value, got valid=%v", it.Valid())
+	}
+
+	rit, err := us.SeekReverse(nil)
+	if err != nil {
+		t.Fatalf("SeekReverse failed: %v", err)
+	}
+	defer rit.Close()
+	if !rit.Valid() || string(rit.Key()) != "k" {
+		t.Fatalf("expected SeekReverse to surface key with empty value, got valid=%v", rit.Valid())
+	}
+}